@@ -0,0 +1,88 @@
+package consensus
+
+import (
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// childDepth returns the depth to assign a block built on top of parent.
+// Depth follows types.Target's convention that a numerically smaller value
+// represents more accumulated work, so childDepth nudges parent's depth down
+// by the smallest possible amount, treating it as a big-endian counter. This
+// keeps Depth.Cmp comparisons between chains of different heights meaningful
+// without requiring the full difficulty-retargeting calculation, which is
+// out of scope here.
+func childDepth(parent types.Target) (depth types.Target) {
+	depth = parent
+	for i := len(depth) - 1; i >= 0; i-- {
+		if depth[i] > 0 {
+			depth[i]--
+			return depth
+		}
+		depth[i] = 0xff
+	}
+	return depth
+}
+
+// AcceptBlock adds block to the consensus set. A block whose ID is already
+// present in the block map is classified and handled by acceptKnownBlock,
+// which returns ErrKnownBlock or ErrKnownSideChain; the latter may still
+// have triggered a reorg onto the side chain. A new block is always added to
+// the block map so that later blocks built on top of it are not orphaned,
+// but it only becomes part of the canonical chain, and only then has its
+// finality checked, if its chain actually outweighs the current tip;
+// integrating it is rejected with ErrReorgTooDeep if doing so would require
+// reorganizing the consensus set across its irreversible block. Either way,
+// if the canonical chain actually changed, every subscriber is notified of
+// the blocks reverted and applied to reach the new tip before AcceptBlock
+// returns.
+func (cs *ConsensusSet) AcceptBlock(block types.Block) error {
+	priorChangeID := cs.changeID
+
+	var acceptErr error
+	if cs.dbBlockKnown(block.ID()) {
+		pb, err := cs.dbGetBlockMap(block.ID())
+		if err != nil {
+			return err
+		}
+		acceptErr = cs.acceptKnownBlock(pb)
+	} else {
+		parent, err := cs.dbGetBlockMap(block.ParentID)
+		if err != nil {
+			return errOrphan
+		}
+		pb := &processedBlock{
+			Block:  block,
+			Height: parent.Height + 1,
+			Depth:  childDepth(parent.Depth),
+		}
+		if err := cs.dbAddBlockMap(pb); err != nil {
+			return err
+		}
+
+		tip := cs.dbCurrentProcessedBlock()
+		if pb.Depth.Cmp(tip.Depth) < 0 {
+			if err := cs.validateFinality(pb); err != nil {
+				return err
+			}
+			if err := cs.forkBlockchain(pb); err != nil {
+				return err
+			}
+		}
+	}
+	if acceptErr != nil && acceptErr != ErrKnownSideChain {
+		return acceptErr
+	}
+
+	if err := cs.updateIrreversibleBlock(); err != nil {
+		return err
+	}
+	reverted, applied, err := cs.changesSince(priorChangeID)
+	if err != nil {
+		return err
+	}
+	cs.updateStateCache(reverted, applied)
+	if len(reverted) > 0 || len(applied) > 0 {
+		cs.notifySubscribers(reverted, applied)
+	}
+	return acceptErr
+}
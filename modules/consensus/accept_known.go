@@ -0,0 +1,77 @@
+package consensus
+
+import (
+	"errors"
+
+	"github.com/NebulousLabs/Sia/types"
+)
+
+var (
+	// ErrKnownBlock is returned by AcceptBlock when the submitted block's ID
+	// is already present in the block map and the block is on the current
+	// canonical chain. Submitting a known canonical block is a no-op, not a
+	// failure.
+	ErrKnownBlock = errors.New("block already exists in the consensus set and is canonical")
+
+	// ErrKnownSideChain is returned by AcceptBlock when the submitted
+	// block's ID is already present in the block map but the block was not
+	// on the canonical chain when it was submitted. It is returned whether
+	// or not accepting it triggered a reorg onto that side chain, so after a
+	// reorg the block may be canonical by the time the error is returned.
+	ErrKnownSideChain = errors.New("block is already known and was not on the canonical chain when submitted")
+
+	// errOrphan is returned when a block's parent is not known to the
+	// consensus set. Unlike ErrKnownBlock and ErrKnownSideChain it is not
+	// exported, and AcceptBlockGroup does not swallow it.
+	errOrphan = errors.New("block's parent is not known to the consensus set")
+)
+
+// acceptKnownBlock classifies a block whose ID is already present in the
+// block map. If the block is on the current canonical path, ErrKnownBlock is
+// returned and nothing else happens. Otherwise the block is a known
+// side-chain block: if pb itself outweighs the current tip (its Depth is
+// below the tip's), a reorg onto the chain ending at pb is performed,
+// subject to the same finality check as a freshly received block. Only pb's
+// own Depth is compared; descendants of pb already in the block map are not
+// considered, so a side chain that only outweighs the tip through those
+// descendants is not adopted here. Regardless of whether a reorg occurred, ErrKnownSideChain is
+// returned so the caller knows the block itself was not freshly appended.
+func (cs *ConsensusSet) acceptKnownBlock(pb *processedBlock) error {
+	current, err := cs.dbGetPath(pb.Height)
+	if err == nil && current == pb.Block.ID() {
+		return ErrKnownBlock
+	}
+
+	tip := cs.dbCurrentProcessedBlock()
+	if pb.Depth.Cmp(tip.Depth) < 0 {
+		if err := cs.validateFinality(pb); err != nil {
+			return err
+		}
+		if err := cs.forkBlockchain(pb); err != nil {
+			return err
+		}
+	}
+	return ErrKnownSideChain
+}
+
+// dbBlockKnown reports whether id is already present in the block map,
+// without requiring the caller to handle the not-found error itself.
+func (cs *ConsensusSet) dbBlockKnown(id types.BlockID) bool {
+	_, err := cs.dbGetBlockMap(id)
+	return err == nil
+}
+
+// AcceptBlockGroup submits a slice of blocks to the consensus set, in the
+// order given, stopping at the first error that is not ErrKnownBlock or
+// ErrKnownSideChain. Those two are swallowed here because a caller handing
+// over a batch of blocks (for instance a peer replying to a blocks request)
+// has no way to know ahead of time which of them this node already has.
+func (cs *ConsensusSet) AcceptBlockGroup(blocks []types.Block) error {
+	for _, block := range blocks {
+		err := cs.AcceptBlock(block)
+		if err != nil && err != ErrKnownBlock && err != ErrKnownSideChain {
+			return err
+		}
+	}
+	return nil
+}
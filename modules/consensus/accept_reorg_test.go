@@ -55,8 +55,11 @@ func (rs *reorgSets) save() {
 			panic(err)
 		}
 
-		// err is not checked - block may already be in cstBackup.
-		_ = rs.cstBackup.cs.AcceptBlock(pb.Block)
+		// The block may already be in cstBackup, on canon or a side chain;
+		// anything else is a real failure.
+		if err := rs.cstBackup.cs.AcceptBlock(pb.Block); err != nil && err != ErrKnownBlock && err != ErrKnownSideChain {
+			panic(err)
+		}
 	}
 
 	// Check that cstMain and cstBackup are even.
@@ -87,7 +90,9 @@ func (rs *reorgSets) extend() {
 		if err != nil {
 			panic(err)
 		}
-		_ = rs.cstMain.cs.AcceptBlock(pb.Block)
+		if err := rs.cstMain.cs.AcceptBlock(pb.Block); err != nil && err != ErrKnownBlock && err != ErrKnownSideChain {
+			panic(err)
+		}
 	}
 
 	// Check that cstMain and cstAlt are even.
@@ -118,7 +123,9 @@ func (rs *reorgSets) restore() {
 		if err != nil {
 			panic(err)
 		}
-		_ = rs.cstMain.cs.AcceptBlock(pb.Block)
+		if err := rs.cstMain.cs.AcceptBlock(pb.Block); err != nil && err != ErrKnownBlock && err != ErrKnownSideChain {
+			panic(err)
+		}
 	}
 
 	// Check that cstMain and cstBackup are even.
@@ -171,6 +178,87 @@ func TestIntegrationSiacoinReorg(t *testing.T) {
 	rs.fullReorg()
 }
 
+// TestIntegrationShallowReorgBeneathFinality reorgs a handful of blocks back
+// out of the consensus set, which should succeed because the reorg does not
+// cross the irreversible block.
+func TestIntegrationShallowReorgBeneathFinality(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	rs := createReorgSets("TestIntegrationShallowReorgBeneathFinality")
+	rs.cstMain.cs.SetFinalityDepth(5)
+
+	rs.cstMain.testSimpleBlock()
+
+	// fullReorg reorgs cstMain back to genesis and then back to its original
+	// blocks, and panics on any error other than ErrKnownBlock or
+	// ErrKnownSideChain, so neither reorg may be refused at this depth.
+	rs.fullReorg()
+
+	height, id := rs.cstMain.cs.IrreversibleBlock()
+	if height > rs.cstMain.cs.dbBlockHeight() {
+		t.Fatal("irreversible block is ahead of the current tip")
+	}
+	if height > 0 && id == (types.BlockID{}) {
+		t.Fatal("irreversible block marker has a height but no ID")
+	}
+}
+
+// TestIntegrationDeepReorgRefused mines enough blocks past a block to make it
+// irreversible, then checks that a competing chain which would force a reorg
+// across that block is refused with ErrReorgTooDeep.
+func TestIntegrationDeepReorgRefused(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	rs := createReorgSets("TestIntegrationDeepReorgRefused")
+	rs.cstMain.cs.SetFinalityDepth(3)
+
+	// Give cstMain a block that will become irreversible, then bury it under
+	// enough confirmations to push the marker past it.
+	rs.cstMain.testSimpleBlock()
+	forkHeight := rs.cstMain.cs.dbBlockHeight()
+	for i := 0; i < 10; i++ {
+		_, err := rs.cstMain.miner.AddBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cstAlt mines a competing chain starting from genesis, which is heavier
+	// than cstMain but would require reorganizing across the now-irreversible
+	// block at forkHeight.
+	for rs.cstAlt.cs.dbBlockHeight() <= rs.cstMain.cs.dbBlockHeight() {
+		_, err := rs.cstAlt.miner.AddBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := rs.cstAlt.cs.dbGetPath(forkHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == (types.BlockID{}) {
+		t.Fatal("expected cstAlt's chain to reach forkHeight")
+	}
+
+	var lastErr error
+	for i := types.BlockHeight(1); i <= rs.cstAlt.cs.dbBlockHeight(); i++ {
+		blockID, err := rs.cstAlt.cs.dbGetPath(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pb, err := rs.cstAlt.cs.dbGetBlockMap(blockID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastErr = rs.cstMain.cs.AcceptBlock(pb.Block)
+	}
+	if lastErr != ErrReorgTooDeep {
+		t.Fatalf("expected ErrReorgTooDeep, got %v", lastErr)
+	}
+}
+
 /// BREAK ///
 /// BREAK ///
 /// BREAK ///
@@ -314,3 +402,173 @@ func TestComplexForking(t *testing.T) {
 		}
 	*/
 }
+
+// BenchmarkFullReorg measures the cost of a full reorg with the in-memory
+// state cache enabled, so that changesSince takes the diffs of blocks still
+// within cs.stateCache's window from memory.
+func BenchmarkFullReorg(b *testing.B) {
+	rs := createReorgSets("BenchmarkFullReorg")
+	rs.cstMain.cs.SetFinalityDepth(1 << 20) // disable finality so deep reorgs are not refused.
+
+	rs.cstMain.testSimpleBlock()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.fullReorg()
+	}
+}
+
+// BenchmarkFullReorgCacheDisabled measures the same workload with the
+// in-memory state cache disabled, so that changesSince takes every diff from
+// the block map, for comparison against BenchmarkFullReorg.
+func BenchmarkFullReorgCacheDisabled(b *testing.B) {
+	rs := createReorgSets("BenchmarkFullReorgCacheDisabled")
+	rs.cstMain.cs.SetFinalityDepth(1 << 20)
+	rs.cstMain.cs.stateCache.disabled = true
+
+	rs.cstMain.testSimpleBlock()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.fullReorg()
+	}
+}
+
+// TestIntegrationReacceptCanonicalBlock checks that resubmitting a block
+// that is already on the current canonical chain is a no-op: it returns
+// ErrKnownBlock and leaves the tip untouched.
+func TestIntegrationReacceptCanonicalBlock(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	cst, err := createConsensusSetTester("TestIntegrationReacceptCanonicalBlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cst.closeCst()
+
+	cst.testSimpleBlock()
+	tip := cst.cs.dbCurrentProcessedBlock()
+
+	err = cst.cs.AcceptBlock(tip.Block)
+	if err != ErrKnownBlock {
+		t.Fatalf("expected ErrKnownBlock, got %v", err)
+	}
+	if cst.cs.dbCurrentProcessedBlock().Block.ID() != tip.Block.ID() {
+		t.Fatal("resubmitting a canonical block moved the tip")
+	}
+}
+
+// TestIntegrationKnownSideChainNoReorg gives a block to cstAlt that is stored
+// but not canonical (because cstAlt's own chain is heavier), then checks
+// that resubmitting it reports ErrKnownSideChain and does not move the tip,
+// since the side chain it belongs to still has less weight than canon.
+func TestIntegrationKnownSideChainNoReorg(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	rs := createReorgSets("TestIntegrationKnownSideChainNoReorg")
+
+	rs.cstMain.testSimpleBlock()
+	sideBlock := rs.cstMain.cs.dbCurrentProcessedBlock().Block
+
+	// cstAlt mines past cstMain's height on its own chain first, so
+	// sideBlock will be stored as a known but non-canonical block when it
+	// is submitted below.
+	for rs.cstAlt.cs.dbBlockHeight() <= rs.cstMain.cs.dbBlockHeight() {
+		_, err := rs.cstAlt.miner.AddBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	altTip := rs.cstAlt.cs.dbCurrentProcessedBlock().Block.ID()
+
+	// Give cstAlt sideBlock's ancestors first, so that sideBlock is not
+	// rejected as an orphan.
+	for i := types.BlockHeight(1); i < rs.cstMain.cs.dbBlockHeight(); i++ {
+		id, err := rs.cstMain.cs.dbGetPath(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pb, err := rs.cstMain.cs.dbGetBlockMap(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.cstAlt.cs.AcceptBlock(pb.Block); err != nil && err != ErrKnownBlock && err != ErrKnownSideChain {
+			t.Fatal(err)
+		}
+	}
+
+	err := rs.cstAlt.cs.AcceptBlock(sideBlock)
+	if err != ErrKnownSideChain && err != nil {
+		t.Fatalf("expected ErrKnownSideChain or a successful store, got %v", err)
+	}
+	err = rs.cstAlt.cs.AcceptBlock(sideBlock)
+	if err != ErrKnownSideChain {
+		t.Fatalf("expected ErrKnownSideChain on resubmission, got %v", err)
+	}
+	if rs.cstAlt.cs.dbCurrentProcessedBlock().Block.ID() != altTip {
+		t.Fatal("known side chain block with less weight moved the tip")
+	}
+}
+
+// mockSubscriber is a ConsensusChangeSubscriber that records every reorg it
+// is handed, so tests can assert that applied and reverted diffs cancel out.
+type mockSubscriber struct {
+	cancel   chan struct{}
+	reverted []RevertedBlock
+	applied  []AppliedBlock
+}
+
+func newMockSubscriber() *mockSubscriber {
+	return &mockSubscriber{cancel: make(chan struct{})}
+}
+
+func (ms *mockSubscriber) ReceiveConsensusChange(_ ChangeID, reverted []RevertedBlock, applied []AppliedBlock) {
+	ms.reverted = append(ms.reverted, reverted...)
+	ms.applied = append(ms.applied, applied...)
+}
+
+func (ms *mockSubscriber) CancelSubscription() <-chan struct{} {
+	return ms.cancel
+}
+
+// TestIntegrationSubscriberFullReorg runs reorgSets.fullReorg with a mock
+// subscriber attached and checks that every block currently on cstMain's
+// canonical chain was applied exactly one more time than it was reverted,
+// and every block that was knocked onto a side chain nets to zero.
+func TestIntegrationSubscriberFullReorg(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	rs := createReorgSets("TestIntegrationSubscriberFullReorg")
+
+	ms := newMockSubscriber()
+	if err := rs.cstMain.cs.ConsensusSetSubscribe(t.Name(), ms, ModuleChangeIDZero); err != nil {
+		t.Fatal(err)
+	}
+
+	rs.cstMain.testSimpleBlock()
+	rs.fullReorg()
+
+	if len(ms.applied) == 0 && len(ms.reverted) == 0 {
+		t.Fatal("subscriber received no consensus changes across a full reorg")
+	}
+
+	appliedIDs := make(map[types.BlockID]int)
+	for _, a := range ms.applied {
+		appliedIDs[a.Block.ID()]++
+	}
+	for _, r := range ms.reverted {
+		appliedIDs[r.Block.ID()]--
+	}
+	for id, count := range appliedIDs {
+		onChain := rs.cstMain.cs.dbPathContains(id)
+		if onChain && count != 1 {
+			t.Fatalf("block %v is canonical but nets to %d applies", id, count)
+		}
+		if !onChain && count != 0 {
+			t.Fatalf("block %v is not canonical but nets to %d applies", id, count)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package consensus
+
+import (
+	"sync"
+
+	"github.com/NebulousLabs/Sia/types"
+	"github.com/NebulousLabs/bolt"
+)
+
+// ConsensusSet tracks the current state of consensus: the block tree rooted
+// at genesis, the canonical path through it, and the auxiliary state
+// (finality, caching, subscriptions) derived from that path.
+type ConsensusSet struct {
+	db *bolt.DB
+
+	blockRoot processedBlock
+
+	// finalityDepth is the number of confirmations a block must accumulate
+	// before AcceptBlock refuses to reorg across it. See finality.go.
+	finalityDepth types.BlockHeight
+
+	// stateCache is the in-memory layer over the on-disk diff buckets. See
+	// statecache.go.
+	stateCache *stateCache
+
+	// subscribers and subscribersMu back the consensus-change subscription
+	// API; changeID identifies the most recent point in history that has
+	// been delivered to them. See subscribe.go.
+	subscribers   []*subscriberCursor
+	subscribersMu sync.Mutex
+	changeID      ChangeID
+}
+
+// New creates a ConsensusSet, opening (or creating) its database in
+// persistDir.
+func New(persistDir string) (*ConsensusSet, error) {
+	cs := &ConsensusSet{
+		finalityDepth: DefaultFinalityDepth,
+		stateCache:    newStateCache(DefaultCacheSize, false),
+	}
+
+	db, err := cs.initPersist(persistDir)
+	if err != nil {
+		return nil, err
+	}
+	cs.db = db
+	cs.changeID = ChangeID(cs.dbCurrentProcessedBlock().Block.ID())
+	cs.warmCache()
+
+	return cs, nil
+}
+
+// Close persists the state cache's checkpoints and closes the consensus
+// set's database. It should be called on every clean shutdown so that the
+// next New can seed the state cache from those checkpoints (see warmCache).
+func (cs *ConsensusSet) Close() error {
+	if err := cs.saveCheckpoints(); err != nil {
+		return err
+	}
+	return cs.db.Close()
+}
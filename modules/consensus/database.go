@@ -0,0 +1,36 @@
+package consensus
+
+import (
+	"path/filepath"
+
+	"github.com/NebulousLabs/bolt"
+)
+
+// consensusDBBuckets lists every bucket the consensus set persists its own
+// state into (as opposed to the block-tree buckets kept elsewhere in the
+// package), so that initPersist can guarantee they exist before any of that
+// state is read or written.
+var consensusDBBuckets = [][]byte{
+	FinalityBucket,
+}
+
+// initPersist opens (or creates) the consensus set's database in persistDir
+// and ensures every bucket it relies on is present.
+func (cs *ConsensusSet) initPersist(persistDir string) (*bolt.DB, error) {
+	db, err := bolt.Open(filepath.Join(persistDir, "consensus.db"), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range consensusDBBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
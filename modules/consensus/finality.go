@@ -0,0 +1,125 @@
+package consensus
+
+import (
+	"errors"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/types"
+	"github.com/NebulousLabs/bolt"
+)
+
+const (
+	// DefaultFinalityDepth is the number of blocks that must be built on top
+	// of a block before it is considered irreversible. Once a block is
+	// irreversible, the consensus set will refuse any block that would
+	// require reorganizing across it.
+	DefaultFinalityDepth = types.BlockHeight(144)
+)
+
+var (
+	// ErrReorgTooDeep is returned when a block would require the consensus
+	// set to reorg across its irreversible block.
+	ErrReorgTooDeep = errors.New("block would require reorganizing past the irreversible block")
+
+	// FinalityBucket stores the irreversible block marker, together with
+	// the state cache's checkpoints and the subscriber cursors. The marker
+	// is written in its own transaction after the tip has moved, so it is
+	// not updated atomically with the current tip.
+	FinalityBucket = []byte("Finality")
+
+	// FieldIrreversibleBlock is the key of the irreversible block marker
+	// within FinalityBucket.
+	FieldIrreversibleBlock = []byte("IrreversibleBlock")
+)
+
+// irreversibleBlock is the on-disk representation of the irreversible
+// marker: the height it was recorded at and the ID of the block at that
+// height.
+type irreversibleBlock struct {
+	Height types.BlockHeight
+	ID     types.BlockID
+}
+
+// dbGetIrreversibleBlock returns the consensus set's current irreversible
+// block marker. If no marker has been set, the zero value is returned.
+func (cs *ConsensusSet) dbGetIrreversibleBlock() (ib irreversibleBlock) {
+	_ = cs.db.View(func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(FinalityBucket).Get(FieldIrreversibleBlock)
+		if bytes == nil {
+			return nil
+		}
+		return encoding.Unmarshal(bytes, &ib)
+	})
+	return ib
+}
+
+// dbSetIrreversibleBlock persists the irreversible block marker so that it
+// survives restarts.
+func (cs *ConsensusSet) dbSetIrreversibleBlock(ib irreversibleBlock) error {
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(FinalityBucket).Put(FieldIrreversibleBlock, encoding.Marshal(ib))
+	})
+}
+
+// updateIrreversibleBlock advances the irreversible marker to reflect the
+// current height of the canonical chain, honoring cs.finalityDepth.
+func (cs *ConsensusSet) updateIrreversibleBlock() error {
+	height := cs.dbBlockHeight()
+	if height < cs.finalityDepth {
+		return nil
+	}
+	irreversibleHeight := height - cs.finalityDepth
+	current := cs.dbGetIrreversibleBlock()
+	if irreversibleHeight <= current.Height && current.ID != (types.BlockID{}) {
+		return nil
+	}
+	id, err := cs.dbGetPath(irreversibleHeight)
+	if err != nil {
+		return err
+	}
+	return cs.dbSetIrreversibleBlock(irreversibleBlock{
+		Height: irreversibleHeight,
+		ID:     id,
+	})
+}
+
+// IrreversibleBlock returns the height and ID of the most recent block that
+// the consensus set considers irreversible. Blocks at or below this height
+// cannot be reorganized away.
+func (cs *ConsensusSet) IrreversibleBlock() (types.BlockHeight, types.BlockID) {
+	ib := cs.dbGetIrreversibleBlock()
+	return ib.Height, ib.ID
+}
+
+// SetFinalityDepth sets the number of confirmations a block must accumulate
+// before it is considered irreversible. It is exposed primarily for testing;
+// production nodes should use DefaultFinalityDepth.
+func (cs *ConsensusSet) SetFinalityDepth(n types.BlockHeight) {
+	cs.finalityDepth = n
+}
+
+// validateFinality returns ErrReorgTooDeep if applying pb would require
+// reorganizing the consensus set across its irreversible block. It walks
+// pb's ancestry back to the point where it joins the current canonical
+// path; if that fork point is below the irreversible block's height, pb
+// belongs to a chain that can never be adopted without rewriting finalized
+// history. A fork at the irreversible block itself keeps that block and is
+// allowed.
+func (cs *ConsensusSet) validateFinality(pb *processedBlock) error {
+	ib := cs.dbGetIrreversibleBlock()
+	if ib.ID == (types.BlockID{}) {
+		return nil
+	}
+	cursor := pb
+	for !cs.dbPathContains(cursor.Block.ID()) {
+		if cursor.Height <= ib.Height {
+			return ErrReorgTooDeep
+		}
+		parent, err := cs.dbGetBlockMap(cursor.Block.ParentID)
+		if err != nil {
+			return err
+		}
+		cursor = parent
+	}
+	return nil
+}
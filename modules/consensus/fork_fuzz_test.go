@@ -0,0 +1,246 @@
+package consensus
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"testing/quick"
+
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// reorgFuzzerWidth is the number of parallel consensusSetTester instances
+// TestReorgFuzzer drives; reorgOpBatch.Generate needs it to pick valid
+// miner/feedTo indices.
+const reorgFuzzerWidth = 3
+
+// reorgFuzzSeedFlag lets a single invocation of `go test` pin the seed; 0
+// (the default) defers to reorgFuzzSeed's other sources.
+var reorgFuzzSeedFlag = flag.Int64("reorgfuzzseed", 0, "seed for TestReorgFuzzer (0 defers to SIA_REORG_FUZZ_SEED, then a fixed default)")
+
+// reorgFuzzSeed resolves the seed for TestReorgFuzzer: an explicit
+// -reorgfuzzseed flag wins, then the SIA_REORG_FUZZ_SEED environment
+// variable (so CI can vary it per run without touching the test), falling
+// back to a fixed seed so a bare `go test` stays reproducible.
+func reorgFuzzSeed() int64 {
+	if *reorgFuzzSeedFlag != 0 {
+		return *reorgFuzzSeedFlag
+	}
+	if s := os.Getenv("SIA_REORG_FUZZ_SEED"); s != "" {
+		if seed, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return seed
+		}
+	}
+	return 1
+}
+
+// reorgOp describes a single fuzzer step: mine 'blocks' blocks (optionally
+// running complexBlockSet first) on tester 'miner', then feed the blocks
+// above the miner's height at the start of the step, up to its current
+// height, to every tester in 'feedTo'.
+type reorgOp struct {
+	miner   int
+	blocks  int
+	complex bool
+	feedTo  []int
+}
+
+// reorgFuzzer generalizes reorgSets to K parallel consensusSetTester
+// instances sharing a genesis block, driven by a recorded sequence of
+// reorgOps so that a failure can be replayed and shrunk.
+type reorgFuzzer struct {
+	testers []*consensusSetTester
+	ops     []reorgOp
+}
+
+// newReorgFuzzer creates a reorgFuzzer with k testers sharing a genesis
+// block, named after 'name'.
+func newReorgFuzzer(name string, k int) (*reorgFuzzer, error) {
+	rf := &reorgFuzzer{testers: make([]*consensusSetTester, k)}
+	for i := range rf.testers {
+		cst, err := createConsensusSetTester(fmt.Sprintf("%s - %d", name, i))
+		if err != nil {
+			return nil, err
+		}
+		rf.testers[i] = cst
+	}
+	return rf, nil
+}
+
+// close releases every tester's resources.
+func (rf *reorgFuzzer) close() {
+	for _, cst := range rf.testers {
+		cst.closeCst()
+	}
+}
+
+// step runs op: mines 'blocks' blocks on the chosen miner (optionally
+// running complexBlockSet for transaction-type coverage), then feeds every
+// block the miner produced this step to the other chosen testers. Errors
+// other than the whitelisted non-extending, known-block and orphan errors
+// fail the step.
+func (rf *reorgFuzzer) step(op reorgOp) error {
+	miner := rf.testers[op.miner%len(rf.testers)]
+	startHeight := miner.cs.dbBlockHeight()
+
+	if op.complex {
+		if err := miner.complexBlockSet(); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < op.blocks; i++ {
+		_, err := miner.miner.AddBlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, height := range op.feedTo {
+		target := rf.testers[height%len(rf.testers)]
+		if target == miner {
+			continue
+		}
+		for h := startHeight + 1; h <= miner.cs.dbBlockHeight(); h++ {
+			id, err := miner.cs.dbGetPath(h)
+			if err != nil {
+				return err
+			}
+			pb, err := miner.cs.dbGetBlockMap(id)
+			if err != nil {
+				return err
+			}
+			err = target.cs.AcceptBlock(pb.Block)
+			if err != nil && err != modules.ErrNonExtendingBlock && err != ErrKnownBlock && err != ErrKnownSideChain && err != errOrphan {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// run executes every recorded op in order, recording it to rf.ops so that a
+// failure can be replayed or shrunk afterwards. Any two testers that share a
+// current tip must also share a consensus checksum and block height.
+func (rf *reorgFuzzer) run(ops []reorgOp) error {
+	for _, op := range ops {
+		rf.ops = append(rf.ops, op)
+		if err := rf.step(op); err != nil {
+			return err
+		}
+		if err := rf.checkConsistency(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkConsistency asserts that any two testers currently on the same tip
+// agree on block height and consensus checksum.
+func (rf *reorgFuzzer) checkConsistency() error {
+	for i := 0; i < len(rf.testers); i++ {
+		for j := i + 1; j < len(rf.testers); j++ {
+			a, b := rf.testers[i], rf.testers[j]
+			if a.cs.dbCurrentProcessedBlock().Block.ID() != b.cs.dbCurrentProcessedBlock().Block.ID() {
+				continue
+			}
+			if a.cs.dbBlockHeight() != b.cs.dbBlockHeight() {
+				return fmt.Errorf("testers %d and %d share a tip but disagree on height", i, j)
+			}
+			if a.cs.dbConsensusChecksum() != b.cs.dbConsensusChecksum() {
+				return fmt.Errorf("testers %d and %d share a tip but disagree on checksum", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+// shrink trims rf.ops down to the minimal prefix-removable, op-removable
+// sequence that still reproduces a failure, by repeatedly dropping one op at
+// a time and re-running from scratch as long as the failure still occurs.
+func (rf *reorgFuzzer) shrink(fails func([]reorgOp) bool) []reorgOp {
+	ops := append([]reorgOp{}, rf.ops...)
+	for i := 0; i < len(ops); {
+		candidate := append(append([]reorgOp{}, ops[:i]...), ops[i+1:]...)
+		if fails(candidate) {
+			ops = candidate
+			continue
+		}
+		i++
+	}
+	return ops
+}
+
+// reorgOpBatch is the unit testing/quick generates and feeds to
+// TestReorgFuzzer's property: a single randomized reorgOp, wrapped so it can
+// implement quick.Generator.
+type reorgOpBatch reorgOp
+
+// Generate implements quick.Generator, producing the same distribution of
+// ops the fuzzer used before it was wired to testing/quick: 1-3 blocks mined
+// by a random tester, occasionally (1 in 10) preceded by a complex block
+// set, fed to a random subset of the other testers.
+func (reorgOpBatch) Generate(rnd *rand.Rand, size int) reflect.Value {
+	feedTo := make([]int, 0, reorgFuzzerWidth)
+	for i := 0; i < reorgFuzzerWidth; i++ {
+		if rnd.Intn(2) == 0 {
+			feedTo = append(feedTo, i)
+		}
+	}
+	return reflect.ValueOf(reorgOpBatch{
+		miner:   rnd.Intn(reorgFuzzerWidth),
+		blocks:  1 + rnd.Intn(3),
+		complex: rnd.Intn(10) == 0,
+		feedTo:  feedTo,
+	})
+}
+
+// TestReorgFuzzer runs a randomized sequence of mines and cross-feeds across
+// several consensusSetTesters sharing a genesis block, asserting that any
+// two testers on the same tip always agree on checksum and height. This
+// fills the gap left by the disabled TestComplexForking: rather than one
+// hand-written fork pattern, it exercises many. The sequence is generated by
+// testing/quick against a seed resolved by reorgFuzzSeed, so a failure can
+// be reproduced exactly by pinning -reorgfuzzseed or SIA_REORG_FUZZ_SEED.
+func TestReorgFuzzer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	seed := reorgFuzzSeed()
+
+	rf, err := newReorgFuzzer(t.Name(), reorgFuzzerWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.close()
+
+	property := func(op reorgOpBatch) bool {
+		return rf.run([]reorgOp{reorgOp(op)}) == nil
+	}
+	cfg := &quick.Config{
+		MaxCount: 25,
+		Rand:     rand.New(rand.NewSource(seed)),
+	}
+	if err := quick.Check(property, cfg); err != nil {
+		cerr, ok := err.(*quick.CheckError)
+		if !ok {
+			t.Fatal(err)
+		}
+		t.Logf("reorg fuzzer failed after %d ops with seed %d: %+v", len(rf.ops), seed, cerr.In[0])
+		attempt := 0
+		minimal := rf.shrink(func(ops []reorgOp) bool {
+			attempt++
+			shrinkRf, err := newReorgFuzzer(fmt.Sprintf("%s-shrink-attempt-%d", t.Name(), attempt), reorgFuzzerWidth)
+			if err != nil {
+				return false
+			}
+			defer shrinkRf.close()
+			return shrinkRf.run(ops) != nil
+		})
+		t.Fatalf("minimal reproducing sequence (%d ops): %+v", len(minimal), minimal)
+	}
+}
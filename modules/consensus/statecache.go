@@ -0,0 +1,203 @@
+package consensus
+
+import (
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/types"
+	"github.com/NebulousLabs/bolt"
+)
+
+// FieldCacheCheckpoints is the key of the serialized tip / tip-1 / tip-N
+// checkpoint block IDs within FinalityBucket.
+var FieldCacheCheckpoints = []byte("CacheCheckpoints")
+
+const (
+	// DefaultCacheSize is the number of processed blocks' diffs that the
+	// state cache keeps in memory. The cache holds copies: every diff is
+	// also stored in its block's entry in the block map, and entries
+	// evicted from the cache are dropped, not written anywhere.
+	DefaultCacheSize = 127
+)
+
+// cachedBlockDiffs holds every diff produced while processing a single
+// block: the diffs are kept together so that the block can be reverted or
+// reapplied as one atomic unit without hitting the database.
+type cachedBlockDiffs struct {
+	height             types.BlockHeight
+	siacoinOutputDiffs []modules.SiacoinOutputDiff
+	fileContractDiffs  []modules.FileContractDiff
+	siafundOutputDiffs []modules.SiafundOutputDiff
+	delayedOutputDiffs []modules.DelayedSiacoinOutputDiff
+	siafundPoolDiff    modules.SiafundPoolDiff
+}
+
+// CacheSize and Disabled are read from the consensus module's configuration
+// when building cs.stateCache (see newStateCache). CacheSize of 0 falls back
+// to DefaultCacheSize; Disabled turns the cache off, so that put stores
+// nothing, every get misses, and changesSince takes every diff from the
+// block map.
+//
+// SetCacheConfig rebuilds cs.stateCache with cacheSize and disabled. It is
+// exposed primarily for testing; production nodes should use New, which
+// already applies DefaultCacheSize with caching enabled.
+func (cs *ConsensusSet) SetCacheConfig(cacheSize uint64, disabled bool) {
+	cs.stateCache = newStateCache(cacheSize, disabled)
+}
+
+// stateCache is a bounded, in-memory copy of recent diffs. It keeps the
+// most recently processed blocks' diffs in RAM, indexed by block ID, and
+// evicts the oldest entries once the cache grows past its configured size.
+type stateCache struct {
+	cacheSize uint64
+	disabled  bool
+
+	diffs map[types.BlockID]*cachedBlockDiffs
+	order []types.BlockID
+}
+
+// newStateCache creates a stateCache respecting the consensus set's
+// CacheSize and Disabled settings.
+func newStateCache(cacheSize uint64, disabled bool) *stateCache {
+	if cacheSize == 0 {
+		cacheSize = DefaultCacheSize
+	}
+	return &stateCache{
+		cacheSize: cacheSize,
+		disabled:  disabled,
+		diffs:     make(map[types.BlockID]*cachedBlockDiffs),
+	}
+}
+
+// put records the diffs for a newly processed block. If the cache is over
+// its configured size afterwards, the oldest entries are evicted and
+// returned. If the cache is disabled, nothing is stored and cbd itself is
+// returned.
+func (sc *stateCache) put(id types.BlockID, cbd *cachedBlockDiffs) (evicted []*cachedBlockDiffs) {
+	if sc.disabled {
+		return []*cachedBlockDiffs{cbd}
+	}
+	sc.diffs[id] = cbd
+	sc.order = append(sc.order, id)
+	for uint64(len(sc.order)) > sc.cacheSize {
+		oldest := sc.order[0]
+		sc.order = sc.order[1:]
+		evicted = append(evicted, sc.diffs[oldest])
+		delete(sc.diffs, oldest)
+	}
+	return evicted
+}
+
+// get returns the cached diffs for id, and whether they were found. A miss
+// means the block's diffs were evicted, were never cached, or the cache is
+// disabled; the caller then takes them from the block's block map entry.
+func (sc *stateCache) get(id types.BlockID) (*cachedBlockDiffs, bool) {
+	cbd, exists := sc.diffs[id]
+	return cbd, exists
+}
+
+// revert discards the cached diffs for id, used when a block is reverted
+// during a reorg and its effects no longer apply.
+func (sc *stateCache) revert(id types.BlockID) {
+	delete(sc.diffs, id)
+	for i, oid := range sc.order {
+		if oid == id {
+			sc.order = append(sc.order[:i], sc.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// checkpoints returns the block IDs that should be persisted as the
+// tip / tip-1 / tip-N checkpoints on clean shutdown, oldest first. Fewer than
+// three IDs are returned if the cache does not yet hold that many blocks.
+func (sc *stateCache) checkpoints() []types.BlockID {
+	n := len(sc.order)
+	if n == 0 {
+		return nil
+	}
+	var indices []int
+	if n >= int(sc.cacheSize) {
+		indices = append(indices, 0)
+	}
+	if n >= 2 {
+		indices = append(indices, n-2)
+	}
+	indices = append(indices, n-1)
+	checkpoints := make([]types.BlockID, 0, len(indices))
+	for _, i := range indices {
+		checkpoints = append(checkpoints, sc.order[i])
+	}
+	return checkpoints
+}
+
+// saveCheckpoints persists the tip / tip-1 / tip-N checkpoints returned by
+// checkpoints() into FinalityBucket. It is called by Close on clean
+// shutdown, and warmCache reads the checkpoints back on the next New to seed
+// the state cache. Nothing is saved on a crash, and no blocks are rewound or
+// replayed from the checkpoints.
+func (cs *ConsensusSet) saveCheckpoints() error {
+	checkpoints := cs.stateCache.checkpoints()
+	if len(checkpoints) == 0 {
+		return nil
+	}
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(FinalityBucket).Put(FieldCacheCheckpoints, encoding.Marshal(checkpoints))
+	})
+}
+
+// updateStateCache reconciles cs.stateCache with a reorg: every reverted
+// block's diffs are dropped from the cache, since they no longer describe
+// the canonical chain, and every applied block's diffs are recorded. The
+// diffs themselves are already durable in each block's entry in the block
+// map; caching the applied ones lets changesSince take their diffs from
+// memory, although it still reads each block's entry from the block map.
+// Evicted entries need no further handling for the same reason.
+func (cs *ConsensusSet) updateStateCache(reverted []RevertedBlock, applied []AppliedBlock) {
+	for _, rb := range reverted {
+		cs.stateCache.revert(rb.Block.ID())
+	}
+	for _, ab := range applied {
+		pb, err := cs.dbGetBlockMap(ab.Block.ID())
+		if err != nil {
+			continue
+		}
+		cs.stateCache.put(ab.Block.ID(), &cachedBlockDiffs{
+			height:             pb.Height,
+			siacoinOutputDiffs: ab.SiacoinOutputDiffs,
+			fileContractDiffs:  ab.FileContractDiffs,
+			siafundOutputDiffs: ab.SiafundOutputDiffs,
+		})
+	}
+}
+
+// dbGetCacheCheckpoints returns the block IDs persisted by saveCheckpoints
+// on the last clean shutdown, oldest first, or nil if none were ever saved.
+func (cs *ConsensusSet) dbGetCacheCheckpoints() (checkpoints []types.BlockID) {
+	_ = cs.db.View(func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(FinalityBucket).Get(FieldCacheCheckpoints)
+		if bytes == nil {
+			return nil
+		}
+		return encoding.Unmarshal(bytes, &checkpoints)
+	})
+	return checkpoints
+}
+
+// warmCache pre-populates cs.stateCache with the diffs of the blocks named
+// by the checkpoints persisted on the last clean shutdown (at most three:
+// tip-N, tip-1 and tip), read from their entries in the block map. The
+// other blocks of the cache's window are not restored.
+func (cs *ConsensusSet) warmCache() {
+	for _, id := range cs.dbGetCacheCheckpoints() {
+		pb, err := cs.dbGetBlockMap(id)
+		if err != nil {
+			continue
+		}
+		cs.stateCache.put(id, &cachedBlockDiffs{
+			height:             pb.Height,
+			siacoinOutputDiffs: pb.SiacoinOutputDiffs,
+			fileContractDiffs:  pb.FileContractDiffs,
+			siafundOutputDiffs: pb.SiafundOutputDiffs,
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package consensus
+
+import (
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/types"
+	"github.com/NebulousLabs/bolt"
+)
+
+// FieldSubscriberCursors is the key of the serialized subscriber-ID ->
+// ChangeID map within FinalityBucket.
+var FieldSubscriberCursors = []byte("SubscriberCursors")
+
+// ChangeID uniquely identifies a point in the consensus set's history. A
+// subscriber stores the most recent ChangeID it has processed so that, after
+// being offline, it can resume from exactly where it left off instead of
+// replaying from genesis.
+type ChangeID types.BlockID
+
+// ModuleChangeIDZero is the ChangeID subscribers should pass to
+// ConsensusSetSubscribe when they have no existing cursor and want to start
+// from genesis.
+var ModuleChangeIDZero = ChangeID{}
+
+// RevertedBlock describes a block being removed from the canonical chain
+// during a reorg, along with the diffs that must be undone to remove its
+// effects.
+type RevertedBlock struct {
+	Block              types.Block
+	SiacoinOutputDiffs []modules.SiacoinOutputDiff
+	FileContractDiffs  []modules.FileContractDiff
+	SiafundOutputDiffs []modules.SiafundOutputDiff
+}
+
+// AppliedBlock describes a block being added to the canonical chain, along
+// with the diffs that must be applied to reflect its effects.
+type AppliedBlock struct {
+	Block              types.Block
+	SiacoinOutputDiffs []modules.SiacoinOutputDiff
+	FileContractDiffs  []modules.FileContractDiff
+	SiafundOutputDiffs []modules.SiafundOutputDiff
+}
+
+// ConsensusChangeSubscriber is implemented by modules that want to be kept
+// informed of every reorg the consensus set performs, in order. CancelSubscription
+// is read non-blockingly before each delivery; closing it (or sending on it)
+// tells the consensus set to stop delivering to this subscriber and to drop
+// it from the subscriber list. Delivery itself is synchronous: a subscriber
+// that blocks inside ReceiveConsensusChange blocks AcceptBlock, and the
+// deliveries to the subscribers after it, until it returns.
+type ConsensusChangeSubscriber interface {
+	// ReceiveConsensusChange is called once per reorg with the blocks
+	// reverted (newest first, so a subscriber undoing their effects never
+	// has to undo a block before the child built on top of it) and the
+	// blocks applied (oldest first) to reach the new tip. changeID
+	// identifies this point in history so the subscriber can later resume
+	// from it.
+	ReceiveConsensusChange(changeID ChangeID, reverted []RevertedBlock, applied []AppliedBlock)
+
+	// CancelSubscription returns a channel that the consensus set checks
+	// before each delivery. If the channel is closed, the subscription is
+	// torn down.
+	CancelSubscription() <-chan struct{}
+}
+
+// subscriberCursor tracks, for one subscriber, the ChangeID it has most
+// recently been caught up to. id is the caller-supplied identity the cursor
+// is persisted under, so that the same subscriber resubscribing after a
+// restart (with no in-memory cursor of its own) can still resume from where
+// it left off instead of replaying from genesis.
+type subscriberCursor struct {
+	id     string
+	sub    ConsensusChangeSubscriber
+	cursor ChangeID
+}
+
+// dbGetSubscriberCursor returns the persisted cursor for id, and whether one
+// has ever been recorded.
+func (cs *ConsensusSet) dbGetSubscriberCursor(id string) (cursor ChangeID, exists bool) {
+	_ = cs.db.View(func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(FinalityBucket).Get(FieldSubscriberCursors)
+		if bytes == nil {
+			return nil
+		}
+		cursors := make(map[string]ChangeID)
+		if err := encoding.Unmarshal(bytes, &cursors); err != nil {
+			return err
+		}
+		cursor, exists = cursors[id]
+		return nil
+	})
+	return cursor, exists
+}
+
+// dbSetSubscriberCursor persists id's cursor so that it survives restarts.
+func (cs *ConsensusSet) dbSetSubscriberCursor(id string, cursor ChangeID) error {
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		cursors := make(map[string]ChangeID)
+		if bytes := tx.Bucket(FinalityBucket).Get(FieldSubscriberCursors); bytes != nil {
+			if err := encoding.Unmarshal(bytes, &cursors); err != nil {
+				return err
+			}
+		}
+		cursors[id] = cursor
+		return tx.Bucket(FinalityBucket).Put(FieldSubscriberCursors, encoding.Marshal(cursors))
+	})
+}
+
+// ConsensusSetSubscribe adds sub to the set of subscribers notified on every
+// reorg, under the caller-supplied id used to persist its cursor across
+// restarts. If from is ModuleChangeIDZero and a cursor was previously
+// persisted under id, that cursor is used instead, so a subscriber that
+// forgot its own progress (for example because it was just restarted) is
+// still caught up from where it left off rather than from genesis. Sub is
+// then caught up synchronously: every block between the common ancestor of
+// the resolved cursor and the current tip is replayed as a revert/apply
+// pair before ConsensusSetSubscribe returns, exactly mirroring what a live
+// reorg notification would have delivered had the subscriber been online
+// the whole time.
+func (cs *ConsensusSet) ConsensusSetSubscribe(id string, sub ConsensusChangeSubscriber, from ChangeID) error {
+	if from == ModuleChangeIDZero {
+		if persisted, exists := cs.dbGetSubscriberCursor(id); exists {
+			from = persisted
+		}
+	}
+
+	cs.subscribersMu.Lock()
+	cs.subscribers = append(cs.subscribers, &subscriberCursor{id: id, sub: sub, cursor: from})
+	cs.subscribersMu.Unlock()
+
+	if from == cs.changeID {
+		return nil
+	}
+	reverted, applied, err := cs.changesSince(from)
+	if err != nil {
+		return err
+	}
+	sub.ReceiveConsensusChange(cs.changeID, reverted, applied)
+	return cs.setSubscriberCursor(sub, cs.changeID)
+}
+
+// Unsubscribe removes sub from the set of subscribers notified on reorgs. It
+// is a no-op if sub was never subscribed.
+func (cs *ConsensusSet) Unsubscribe(sub ConsensusChangeSubscriber) {
+	cs.subscribersMu.Lock()
+	defer cs.subscribersMu.Unlock()
+	for i, sc := range cs.subscribers {
+		if sc.sub == sub {
+			cs.subscribers = append(cs.subscribers[:i], cs.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// setSubscriberCursor updates the in-memory and persisted cursor for sub, so
+// that a restart does not force a full replay for subscribers that were
+// caught up.
+func (cs *ConsensusSet) setSubscriberCursor(sub ConsensusChangeSubscriber, id ChangeID) error {
+	cs.subscribersMu.Lock()
+	var subID string
+	for _, sc := range cs.subscribers {
+		if sc.sub == sub {
+			sc.cursor = id
+			subID = sc.id
+			break
+		}
+	}
+	cs.subscribersMu.Unlock()
+	return cs.dbSetSubscriberCursor(subID, id)
+}
+
+// changesSince returns the reverted and applied blocks needed to walk the
+// consensus set from ChangeID 'from' to the current tip, replaying reverts
+// back to the common ancestor before applying forward. If 'from' is not
+// found in the block map (including ModuleChangeIDZero), no error is
+// returned: every block from genesis to the current tip is reported as
+// applied.
+func (cs *ConsensusSet) changesSince(from ChangeID) (reverted []RevertedBlock, applied []AppliedBlock, err error) {
+	pb, err := cs.dbGetBlockMap(types.BlockID(from))
+	if err != nil {
+		// The subscriber's cursor predates anything we have; replay
+		// everything from genesis.
+		pb, err = cs.dbGetBlockMap(cs.blockRoot.Block.ID())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Walk back from the subscriber's block through its ancestors to find
+	// the common ancestor with the current canonical chain, collecting
+	// reverts as we go. Each block is read from the block map; its diffs are
+	// taken from the state cache when the cache holds them.
+	for !cs.dbPathContains(pb.Block.ID()) {
+		rb := RevertedBlock{Block: pb.Block}
+		if cbd, ok := cs.stateCache.get(pb.Block.ID()); ok {
+			rb.SiacoinOutputDiffs = cbd.siacoinOutputDiffs
+			rb.FileContractDiffs = cbd.fileContractDiffs
+			rb.SiafundOutputDiffs = cbd.siafundOutputDiffs
+		} else {
+			rb.SiacoinOutputDiffs = pb.SiacoinOutputDiffs
+			rb.FileContractDiffs = pb.FileContractDiffs
+			rb.SiafundOutputDiffs = pb.SiafundOutputDiffs
+		}
+		reverted = append(reverted, rb)
+		pb, err = cs.dbGetBlockMap(pb.Block.ParentID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Walk forward from the common ancestor to the current tip, collecting
+	// applies, again preferring the cached diffs over the block map's.
+	for h := pb.Height + 1; h <= cs.dbBlockHeight(); h++ {
+		id, err := cs.dbGetPath(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		apb, err := cs.dbGetBlockMap(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		ab := AppliedBlock{Block: apb.Block}
+		if cbd, ok := cs.stateCache.get(id); ok {
+			ab.SiacoinOutputDiffs = cbd.siacoinOutputDiffs
+			ab.FileContractDiffs = cbd.fileContractDiffs
+			ab.SiafundOutputDiffs = cbd.siafundOutputDiffs
+		} else {
+			ab.SiacoinOutputDiffs = apb.SiacoinOutputDiffs
+			ab.FileContractDiffs = apb.FileContractDiffs
+			ab.SiafundOutputDiffs = apb.SiafundOutputDiffs
+		}
+		applied = append(applied, ab)
+	}
+	return reverted, applied, nil
+}
+
+// notifySubscribers delivers a reorg to every subscriber, skipping (and
+// removing) any whose CancelSubscription channel has been closed. The
+// channel is only checked before a delivery starts. Delivery itself happens
+// outside of subscribersMu, so a subscriber slow to return from
+// ReceiveConsensusChange does not block Subscribe/Unsubscribe; it does block
+// the deliveries to the subscribers after it and the return of the
+// AcceptBlock call that triggered the notification.
+func (cs *ConsensusSet) notifySubscribers(reverted []RevertedBlock, applied []AppliedBlock) {
+	cs.changeID = ChangeID(cs.dbCurrentProcessedBlock().Block.ID())
+	changeID := cs.changeID
+
+	cs.subscribersMu.Lock()
+	snapshot := append([]*subscriberCursor(nil), cs.subscribers...)
+	cs.subscribersMu.Unlock()
+
+	cancelled := make(map[*subscriberCursor]bool)
+	for _, sc := range snapshot {
+		select {
+		case <-sc.sub.CancelSubscription():
+			cancelled[sc] = true
+			continue
+		default:
+		}
+		sc.sub.ReceiveConsensusChange(changeID, reverted, applied)
+		sc.cursor = changeID
+		if err := cs.dbSetSubscriberCursor(sc.id, changeID); err != nil {
+			cancelled[sc] = true
+		}
+	}
+
+	cs.subscribersMu.Lock()
+	defer cs.subscribersMu.Unlock()
+	live := cs.subscribers[:0]
+	for _, sc := range cs.subscribers {
+		if !cancelled[sc] {
+			live = append(live, sc)
+		}
+	}
+	cs.subscribers = live
+}